@@ -25,8 +25,12 @@
 package main
 
 import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -38,6 +42,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/creack/pty"
 	"golang.org/x/sys/unix"
 )
 
@@ -45,6 +50,304 @@ var mainLogger *log.Logger
 var hbLogger *log.Logger
 var launchLogger *log.Logger
 var scriptLogger *log.Logger
+var structLogger *structLog
+var currentLogLevel int
+
+// Levels for -loglevel, ordered least to most verbose. The MAIN/HEARTBEAT/
+// LAUNCHER loggers are component loggers rather than severity-tagged ones,
+// so there are only two real thresholds: "debug" gates them on (same as the
+// old -debug flag), and "trace" additionally un-gates the one call site
+// noisy enough to matter only there (the once-per-tick heartbeat message).
+// There is no per-call-site error/warn/info filtering.
+const (
+	levelOff = iota
+	levelDebug
+	levelTrace
+)
+
+func parseLogLevel(level string) int {
+	switch strings.ToLower(level) {
+	case "trace":
+		return levelTrace
+	case "debug":
+		return levelDebug
+	default:
+		return levelOff
+	}
+}
+
+// rotatingWriter is an io.Writer over the debug log file that rotates itself
+// once it exceeds maxSize, keeping maxBackups old generations (path.1,
+// path.2, ...). reopen is also what SIGHUP triggers, so external logrotate
+// can manage the file instead if preferred.
+type rotatingWriter struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func newRotatingWriter(path string, maxSize int64, maxBackups int) (*rotatingWriter, error) {
+	w := &rotatingWriter{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := w.reopen(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *rotatingWriter) reopen() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file != nil {
+		w.file.Close()
+	}
+	file, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	w.file = file
+	w.size = info.Size()
+	return nil
+}
+
+func (w *rotatingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.maxSize > 0 && w.size+int64(len(p)) > w.maxSize {
+		w.rotateLocked()
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// rotateLocked must be called with mu held.
+func (w *rotatingWriter) rotateLocked() {
+	w.file.Close()
+	for i := w.maxBackups; i > 0; i-- {
+		older := fmt.Sprintf("%v.%v", w.path, i)
+		newer := w.path
+		if i > 1 {
+			newer = fmt.Sprintf("%v.%v", w.path, i-1)
+		}
+		os.Rename(newer, older)
+	}
+	file, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err == nil {
+		w.file = file
+		w.size = 0
+	}
+}
+
+func (w *rotatingWriter) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file != nil {
+		w.file.Close()
+	}
+}
+
+// structRecord is one line of the optional structured (rec/json) log: a
+// parallel, machine-readable copy of the script's output tagged by stream so
+// Jenkins can reconstruct stdout vs stderr and correlate heartbeat gaps with
+// script output during post-mortem, without breaking the existing plain log.
+type structRecord struct {
+	Seq     uint64 `json:"seq"`
+	Time    string `json:"time"`
+	Stream  string `json:"stream"`
+	Pid     int    `json:"pid"`
+	Payload string `json:"payload"`
+}
+
+// structLog appends structRecords to logPath+".rec" or logPath+".ndjson",
+// one per line, flushing on every write so a killed process still leaves a
+// valid tail. Safe for concurrent use since stdout and stderr are teed
+// through it at the same time.
+type structLog struct {
+	mu     sync.Mutex
+	file   *os.File
+	format string
+	seq    uint64
+}
+
+// openStructLog returns nil, nil when format is empty so callers can treat a
+// disabled structured log the same as an enabled one via the nil-safe
+// methods below.
+func openStructLog(logPath string, format string) (*structLog, error) {
+	if format == "" {
+		return nil, nil
+	}
+	ext := ".rec"
+	if format == "json" {
+		ext = ".ndjson"
+	}
+	file, err := os.Create(logPath + ext)
+	if err != nil {
+		return nil, err
+	}
+	return &structLog{file: file, format: format}, nil
+}
+
+func (s *structLog) close() {
+	if s == nil {
+		return
+	}
+	s.file.Close()
+}
+
+func (s *structLog) write(stream string, pid int, payload []byte) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	rec := structRecord{
+		Seq:     s.seq,
+		Time:    time.Now().Format(time.RFC3339Nano),
+		Stream:  stream,
+		Pid:     pid,
+		Payload: base64.StdEncoding.EncodeToString(payload),
+	}
+	if s.format == "json" {
+		if enc, err := json.Marshal(rec); err == nil {
+			s.file.Write(enc)
+			s.file.Write([]byte("\n"))
+		}
+	} else {
+		fmt.Fprintf(s.file, "Seq: %v\nTime: %v\nStream: %v\nPid: %v\nPayload: %v\n\n",
+			rec.Seq, rec.Time, rec.Stream, rec.Pid, rec.Payload)
+	}
+	s.file.Sync()
+}
+
+// tee copies every write to dst and also splits it into lines recorded under
+// stream, tagged with whatever pidOf returns at record time (the script pid
+// is not known until after the goroutine is wired up, so it is read lazily).
+// Returns a closer that must be called once dst will no longer be written to,
+// so the line-splitting goroutine can exit. Safe to call on a nil *structLog.
+func (s *structLog) tee(dst io.Writer, stream string, pidOf func() int) (io.Writer, func()) {
+	if s == nil {
+		return dst, func() {}
+	}
+	pipeReader, pipeWriter := io.Pipe()
+	go func() {
+		scanner := bufio.NewScanner(pipeReader)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			s.write(stream, pidOf(), scanner.Bytes())
+		}
+	}()
+	return io.MultiWriter(dst, pipeWriter), func() { pipeWriter.Close() }
+}
+
+// parseEnvFile reads KEY=VALUE lines, skipping blank lines and lines whose
+// first non-blank character is '#'. A value may be wrapped in matching single
+// or double quotes to include leading/trailing whitespace.
+func parseEnvFile(envFilePath string) ([]string, error) {
+	contents, err := ioutil.ReadFile(envFilePath)
+	if err != nil {
+		return nil, err
+	}
+	var env []string
+	for _, line := range strings.Split(string(contents), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		eq := strings.Index(trimmed, "=")
+		if eq < 0 {
+			continue
+		}
+		key := strings.TrimSpace(trimmed[:eq])
+		val := strings.TrimSpace(trimmed[eq+1:])
+		if len(val) >= 2 {
+			if (val[0] == '"' && val[len(val)-1] == '"') || (val[0] == '\'' && val[len(val)-1] == '\'') {
+				val = val[1 : len(val)-1]
+			}
+		}
+		env = append(env, key+"="+val)
+	}
+	return env, nil
+}
+
+// buildScriptEnv assembles the environment for the launched script. When
+// envFilePath is set, the file's contents are the *exclusive* base (the JVM's
+// own environment is not inherited); -envpassthrough then selectively adds
+// back named vars from the parent, and -envunset scrubs named vars from
+// whatever base was chosen either way, so callers can declare a reproducible
+// environment without leaking agent internals (JENKINS_HOME, _JAVA_OPTIONS, ...)
+// into user scripts.
+func buildScriptEnv(envFilePath string, envPassthrough string, envUnset string, cookieString string) ([]string, error) {
+	var env []string
+	if envFilePath != "" {
+		fileEnv, err := parseEnvFile(envFilePath)
+		if err != nil {
+			return nil, err
+		}
+		env = fileEnv
+		for _, name := range splitNonEmpty(envPassthrough) {
+			if val, ok := os.LookupEnv(name); ok {
+				env = append(env, name+"="+val)
+			}
+		}
+	} else {
+		env = os.Environ()
+	}
+
+	// -envunset only ever scrubs the base environment chosen above;
+	// the Jenkins cookie is appended afterwards so it can never be stripped,
+	// since without it Jenkins loses the ability to track and kill this
+	// process tree.
+	unset := splitNonEmpty(envUnset)
+	env = append(filterEnv(env, unset), cookieString)
+	return env, nil
+}
+
+// filterEnv drops any KEY=VALUE entries whose key is in unset. Returns env
+// unchanged (not copied) if unset is empty.
+func filterEnv(env []string, unset []string) []string {
+	if len(unset) == 0 {
+		return env
+	}
+	filtered := make([]string, 0, len(env))
+	for _, kv := range env {
+		key := kv
+		if eq := strings.Index(kv, "="); eq >= 0 {
+			key = kv[:eq]
+		}
+		scrub := false
+		for _, name := range unset {
+			if key == name {
+				scrub = true
+				break
+			}
+		}
+		if !scrub {
+			filtered = append(filtered, kv)
+		}
+	}
+	return filtered
+}
+
+// splitNonEmpty splits a comma-separated list, dropping empty entries.
+func splitNonEmpty(list string) []string {
+	var out []string
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
 
 func checkIfErr(process string, err error) bool {
 	if err != nil {
@@ -66,17 +369,321 @@ func loggerIfErr(logger *log.Logger, err error) bool {
 	return false
 }
 
+// timeoutReason latches the first resource-limit reason a watchdog fires for,
+// so the launcher can report -3 (wall) or -4 (cpu) instead of whatever signal
+// exit code the killed process happened to produce.
+type timeoutReason struct {
+	mu     sync.Mutex
+	reason string
+}
+
+func (t *timeoutReason) set(reason string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.reason == "" {
+		t.reason = reason
+	}
+}
+
+func (t *timeoutReason) get() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.reason
+}
+
+// cpuLimitHardMarginSeconds is how far the hard RLIMIT_CPU is set above the
+// soft one, so SIGXCPU reliably arrives before the kernel's own SIGKILL.
+const cpuLimitHardMarginSeconds = 2
+
+// wrapWithRlimits rewrites cmd so that RLIMIT_CPU/AS/NPROC/FSIZE land on the
+// launched script only. Go's os/exec has no fork-without-exec hook, so
+// calling unix.Setrlimit directly in this process would permanently lower
+// the *monitor's* own limits too: a modest -memlimit can crash the Go
+// runtime's address-space reservations, a low -cpulimit can SIGXCPU/SIGKILL
+// the monitor itself after enough accumulated goroutine CPU time, and
+// RLIMIT_NPROC is accounted per real UID system-wide, so it would starve the
+// whole agent user rather than just this script's children. Instead we exec
+// a `sh -c 'ulimit ...; exec "$@"'` wrapper: the shell sets the limits on
+// itself and then execs the real command in place (same pid, same process),
+// so the limits apply to the script's process tree without ever touching
+// the monitor. Returns cmd unchanged if every limit is zero.
+func wrapWithRlimits(cmd *exec.Cmd, cpuSeconds uint64, memBytes uint64, nprocs uint64, filesizeBytes uint64) *exec.Cmd {
+	var ulimits []string
+	if cpuSeconds > 0 {
+		// Soft and hard RLIMIT_CPU must differ, or the kernel delivers
+		// SIGKILL directly once the limit is hit instead of SIGXCPU first;
+		// giving the hard limit a small margin over the soft one lets us
+		// reliably observe SIGXCPU (see killedBySignal) before the process
+		// is killed outright.
+		ulimits = append(ulimits,
+			fmt.Sprintf("ulimit -S -t %d", cpuSeconds),
+			fmt.Sprintf("ulimit -H -t %d", cpuSeconds+cpuLimitHardMarginSeconds))
+	}
+	if memBytes > 0 {
+		// ulimit -v takes KiB, RLIMIT_AS is in bytes
+		ulimits = append(ulimits, fmt.Sprintf("ulimit -v %d", memBytes/1024))
+	}
+	if nprocs > 0 {
+		ulimits = append(ulimits, fmt.Sprintf("ulimit -u %d", nprocs))
+	}
+	if filesizeBytes > 0 {
+		// ulimit -f takes 512-byte blocks, RLIMIT_FSIZE is in bytes
+		ulimits = append(ulimits, fmt.Sprintf("ulimit -f %d", filesizeBytes/512))
+	}
+	if len(ulimits) == 0 {
+		return cmd
+	}
+	wrapperScript := strings.Join(ulimits, "; ") + "; exec \"$@\""
+	wrappedArgs := append([]string{"-c", wrapperScript, "sh", cmd.Path}, cmd.Args[1:]...)
+	return exec.Command("/bin/sh", wrappedArgs...)
+}
+
+// watchdog sends SIGTERM to the script's whole process group (the pgid
+// equals its pid since it was started with Setsid) once timeout elapses,
+// escalating to SIGKILL after killGrace if it is still alive. doneChan is
+// closed by the caller as soon as the script exits so a watchdog that never
+// fires doesn't leak. reason is latched via latch.set so the launcher can
+// classify the abort once Wait() returns.
+func watchdog(pgid int, timeout time.Duration, killGrace time.Duration, doneChan chan struct{}, latch *timeoutReason, reason string) {
+	if timeout <= 0 {
+		return
+	}
+	select {
+	case <-doneChan:
+		return
+	case <-time.After(timeout):
+	}
+	latch.set(reason)
+	launchLogger.Printf("%v exceeded, sending SIGTERM to pgid %v\n", reason, pgid)
+	syscall.Kill(-pgid, syscall.SIGTERM)
+	select {
+	case <-doneChan:
+	case <-time.After(killGrace):
+		launchLogger.Printf("%v: still alive after grace period, sending SIGKILL to pgid %v\n", reason, pgid)
+		syscall.Kill(-pgid, syscall.SIGKILL)
+	}
+}
+
+// fifoTailCap bounds the on-disk tail buffer fifoWriter falls back to while
+// no reader has the pipe attached, so a chatty job with nobody tailing it
+// still bounds agent disk usage instead of growing a scratch file forever.
+const fifoTailCap = 4 * 1024 * 1024 // 4 MiB retained
+
+// fifoWriter streams script output through a named pipe (-fifo) for
+// constant-space log tailing instead of requiring the whole log to live on
+// disk. Writes go to the pipe only while a reader is attached; if no reader
+// has the pipe open yet, or the reader disconnects mid-write (EPIPE), writes
+// fall back to a fixed-size ring buffer on disk (the last fifoTailCap bytes)
+// so the most recent output is kept while disk usage stays bounded; output
+// older than that is overwritten. A background loop keeps
+// retrying to attach the pipe so tailing can resume once a reader comes back.
+type fifoWriter struct {
+	mu       sync.Mutex
+	fifoPath string
+	pipeFile *os.File
+	tailFile *os.File
+	tailCap  int64
+	tailPos  int64
+	stopChan chan struct{}
+}
+
+func newFifoWriter(fifoPath string, tailPath string) (*fifoWriter, error) {
+	_ = os.Remove(fifoPath)
+	if err := unix.Mkfifo(fifoPath, 0600); err != nil {
+		return nil, err
+	}
+	tailFile, err := os.Create(tailPath)
+	if err != nil {
+		return nil, err
+	}
+	f := &fifoWriter{fifoPath: fifoPath, tailFile: tailFile, tailCap: fifoTailCap, stopChan: make(chan struct{})}
+	f.tryAttach()
+	go f.retryLoop()
+	return f, nil
+}
+
+// tryAttach opens the FIFO non-blocking; this only succeeds once a reader
+// already has the other end open, otherwise writes keep going to scratch.
+func (f *fifoWriter) tryAttach() {
+	file, err := os.OpenFile(f.fifoPath, os.O_WRONLY|unix.O_NONBLOCK, os.ModeNamedPipe)
+	if err != nil {
+		return
+	}
+	f.mu.Lock()
+	f.pipeFile = file
+	f.mu.Unlock()
+}
+
+func (f *fifoWriter) retryLoop() {
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.stopChan:
+			return
+		case <-ticker.C:
+			f.mu.Lock()
+			attached := f.pipeFile != nil
+			f.mu.Unlock()
+			if !attached {
+				f.tryAttach()
+			}
+		}
+	}
+}
+
+func (f *fifoWriter) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	pipeFile := f.pipeFile
+	f.mu.Unlock()
+	if pipeFile != nil {
+		if _, err := pipeFile.Write(p); err == nil {
+			return len(p), nil
+		}
+		// reader disconnected (EPIPE) or pipe otherwise broken; detach and
+		// fall through to the bounded tail buffer below, retryLoop will
+		// reattach the pipe in the background if a reader comes back
+		f.mu.Lock()
+		f.pipeFile = nil
+		f.mu.Unlock()
+		pipeFile.Close()
+	}
+	return f.writeTail(p)
+}
+
+// writeTail writes p into the fixed-size ring buffer backing the tail file,
+// wrapping back to offset 0 once tailCap is reached so the file never grows
+// past tailCap regardless of how much output the script produces.
+func (f *fifoWriter) writeTail(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if remain := f.tailCap - f.tailPos; int64(len(chunk)) > remain {
+			chunk = chunk[:remain]
+		}
+		n, err := f.tailFile.WriteAt(chunk, f.tailPos)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		f.tailPos += int64(n)
+		if f.tailPos >= f.tailCap {
+			f.tailPos = 0
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (f *fifoWriter) close() {
+	close(f.stopChan)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.pipeFile != nil {
+		f.pipeFile.Close()
+	}
+	f.tailFile.Close()
+}
+
 // Catch termination signals to allow for a graceful exit (i.e. no zombies)
 // Only for this process, does not catch any signals to the launched script.
-func signalCatcher(sigChan chan os.Signal) {
+// SIGHUP additionally reopens the rotating debug log, so external logrotate
+// can manage it instead of -logmaxsize/-logmaxbackups if preferred.
+func signalCatcher(sigChan chan os.Signal, debugLog *rotatingWriter) {
 	for sig := range sigChan {
 		mainLogger.Printf("(sig catcher) caught: %v\n", sig)
+		if sig == unix.SIGHUP && debugLog != nil {
+			checkIfErr("launcher", debugLog.reopen())
+		}
 	}
 }
 
+// exitMeta is the optional sibling of the numeric result file (-resultmeta),
+// giving Jenkins richer failure diagnostics than a bare exit code.
+type exitMeta struct {
+	ExitCode   int
+	Signal     string
+	UserTimeMs int64
+	SysTimeMs  int64
+	MaxRSSKb   int64
+	StartedAt  time.Time
+	FinishedAt time.Time
+	Reason     string // normal|walltimeout|cputimeout|launch-failure
+}
+
+func formatTimeOrEmpty(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+// signalFromState reports the signal name that terminated the process, or
+// "" if it exited normally.
+func signalFromState(state *os.ProcessState) string {
+	if state == nil {
+		return ""
+	}
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return ws.Signal().String()
+	}
+	return ""
+}
+
+// killedBySignal reports whether the process was terminated by sig, checked
+// by signal number rather than by matching the name String() renders.
+func killedBySignal(state *os.ProcessState, sig unix.Signal) bool {
+	if state == nil {
+		return false
+	}
+	ws, ok := state.Sys().(syscall.WaitStatus)
+	return ok && ws.Signaled() && syscall.Signal(sig) == ws.Signal()
+}
+
+// rusageFromState reads the child's resource usage off its ProcessState; all
+// zero if unavailable.
+func rusageFromState(state *os.ProcessState) (userMs int64, sysMs int64, maxRSSKb int64) {
+	if state == nil {
+		return 0, 0, 0
+	}
+	if ru, ok := state.SysUsage().(*syscall.Rusage); ok {
+		userMs = int64(ru.Utime.Sec)*1000 + int64(ru.Utime.Usec)/1000
+		sysMs = int64(ru.Stime.Sec)*1000 + int64(ru.Stime.Usec)/1000
+		maxRSSKb = int64(ru.Maxrss)
+	}
+	return
+}
+
+// writeResultMeta writes the recfile-style metadata block to
+// resultPath+".meta", via a temp file and rename so a reader never observes
+// a partially written one.
+func writeResultMeta(resultPath string, meta exitMeta) error {
+	metaPath := resultPath + ".meta"
+	tmpPath := metaPath + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	var wallMs int64
+	if !meta.StartedAt.IsZero() && !meta.FinishedAt.IsZero() {
+		wallMs = meta.FinishedAt.Sub(meta.StartedAt).Nanoseconds() / int64(time.Millisecond)
+	}
+	fmt.Fprintf(file, "ExitCode: %v\nSignal: %v\nUserTimeMs: %v\nSysTimeMs: %v\nMaxRSSKb: %v\nStartedAt: %v\nFinishedAt: %v\nWallMs: %v\nReason: %v\n",
+		meta.ExitCode, meta.Signal, meta.UserTimeMs, meta.SysTimeMs, meta.MaxRSSKb,
+		formatTimeOrEmpty(meta.StartedAt), formatTimeOrEmpty(meta.FinishedAt), wallMs, meta.Reason)
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, metaPath)
+}
+
 // Launches the script in a new session and waits for its completion.
 func launcher(wg *sync.WaitGroup, exitChan chan bool, cookieName string, cookieVal string,
-	interpreter string, scriptPath string, resultPath string, outputPath string) {
+	interpreter string, scriptPath string, resultPath string, outputPath string, stderrPath string,
+	envFilePath string, envPassthrough string, envUnset string,
+	cpuLimit uint64, memLimit uint64, nprocs uint64, filesize uint64,
+	wallTimeout time.Duration, cpuTimeout time.Duration, killGrace time.Duration, fifoPath string,
+	resultMeta bool, ttyEnabled bool, ttyRows int, ttyCols int) {
 
 	defer wg.Done()
 	defer signalFinished(exitChan)
@@ -87,15 +694,42 @@ func launcher(wg *sync.WaitGroup, exitChan chan bool, cookieName string, cookieV
 	} else {
 		scriptCmd = exec.Command(scriptPath)
 	}
+	// RLIMIT_CPU doubles as the enforcement mechanism for -cputimeout: if no
+	// explicit -cpulimit was given, derive a cpu-seconds ceiling from it so
+	// the kernel delivers SIGXCPU/SIGKILL to the script on our behalf.
+	rlimitCPUSeconds := cpuLimit
+	if rlimitCPUSeconds == 0 && cpuTimeout > 0 {
+		rlimitCPUSeconds = uint64(cpuTimeout.Round(time.Second) / time.Second)
+		if rlimitCPUSeconds == 0 {
+			rlimitCPUSeconds = 1
+		}
+	}
+	scriptCmd = wrapWithRlimits(scriptCmd, rlimitCPUSeconds, memLimit, nprocs, filesize)
 	cookieString := fmt.Sprintf("%v=%v", cookieName, cookieVal)
-	scriptCmd.Env = append(os.Environ(),
-		cookieString)
+	scriptEnv, err := buildScriptEnv(envFilePath, envPassthrough, envUnset, cookieString)
+	if checkScriptErr(err) {
+		exitLauncher(-2, resultPath, resultMeta, exitMeta{Reason: "launch-failure"})
+		return
+	}
+	scriptCmd.Env = scriptEnv
 
-	if outputPath != "" {
+	if fifoPath != "" {
+		// stream output through a named pipe instead of a plain file, bounding
+		// agent disk usage for chatty scripts; see fifoWriter for the
+		// scratch-file fallback when no reader is attached.
+		fifoStreamer, err := newFifoWriter(fifoPath, fifoPath+".tail")
+		if checkScriptErr(err) {
+			exitLauncher(-2, resultPath, resultMeta, exitMeta{Reason: "launch-failure"})
+			return
+		}
+		defer fifoStreamer.close()
+		scriptCmd.Stdout = fifoStreamer
+		scriptCmd.Stderr = fifoStreamer
+	} else if outputPath != "" {
 		// capturing output
 		outputFile, err := os.Create(outputPath)
 		if checkScriptErr(err) {
-			exitLauncher(-2, resultPath)
+			exitLauncher(-2, resultPath, resultMeta, exitMeta{Reason: "launch-failure"})
 			return
 		}
 		defer outputFile.Close()
@@ -105,31 +739,139 @@ func launcher(wg *sync.WaitGroup, exitChan chan bool, cookieName string, cookieV
 		scriptCmd.Stdout = scriptLogger.Writer()
 		scriptCmd.Stderr = scriptCmd.Stdout
 	}
-	// Create new session
-	scriptCmd.SysProcAttr = &unix.SysProcAttr{Setsid: true}
+	if stderrPath != "" {
+		// stderr goes exclusively to its own file, never mixed with stdout or the launcher log
+		stderrFile, err := os.Create(stderrPath)
+		if checkScriptErr(err) {
+			exitLauncher(-2, resultPath, resultMeta, exitMeta{Reason: "launch-failure"})
+			return
+		}
+		defer stderrFile.Close()
+		scriptCmd.Stderr = stderrFile
+	}
+	// Tee stdout/stderr into the structured log (if enabled) before the pid is
+	// known; pidOfScript is read lazily once Start() has filled it in.
+	var scriptPid int
+	pidOfScript := func() int { return scriptPid }
+	stdoutWriter, closeStdoutTee := structLogger.tee(scriptCmd.Stdout, "stdout", pidOfScript)
+	scriptCmd.Stdout = stdoutWriter
+	stderrWriter, closeStderrTee := structLogger.tee(scriptCmd.Stderr, "stderr", pidOfScript)
+	scriptCmd.Stderr = stderrWriter
+
+	// -tty attaches a pseudo-terminal to stdin/stdout/stderr instead of the
+	// file-based redirection above, so tools that check isatty() (npm, pip,
+	// docker, ...) emit progress bars and color; its combined output still
+	// ends up in stdoutWriter (and so the structured log) via ptyMaster.
+	var ptyMaster, ptySlave *os.File
+	if ttyEnabled {
+		var ptyErr error
+		ptyMaster, ptySlave, ptyErr = pty.Open()
+		if checkScriptErr(ptyErr) {
+			exitLauncher(-2, resultPath, resultMeta, exitMeta{Reason: "launch-failure"})
+			return
+		}
+		if err := pty.Setsize(ptyMaster, &pty.Winsize{Rows: uint16(ttyRows), Cols: uint16(ttyCols)}); checkScriptErr(err) {
+			// non-fatal: the tool falls back to its own default size
+		}
+		scriptCmd.Stdin = ptySlave
+		scriptCmd.Stdout = ptySlave
+		scriptCmd.Stderr = ptySlave
+		// Setctty makes the slave the controlling terminal of the new session;
+		// Ctty is an fd number in the child, where fd 0 (stdin) is the slave
+		scriptCmd.SysProcAttr = &unix.SysProcAttr{Setsid: true, Setctty: true, Ctty: 0}
+	} else {
+		// Create new session
+		scriptCmd.SysProcAttr = &unix.SysProcAttr{Setsid: true}
+	}
 	for i := 0; i < len(scriptCmd.Args); i++ {
 		launchLogger.Printf("args %v: %v\n", i, scriptCmd.Args[i])
 	}
-	err := scriptCmd.Start()
+	err = scriptCmd.Start()
 	if checkScriptErr(err) {
-		exitLauncher(-2, resultPath)
+		exitLauncher(-2, resultPath, resultMeta, exitMeta{Reason: "launch-failure"})
 		return
 	}
 	pid := scriptCmd.Process.Pid
+	scriptPid = pid
+	startedAt := time.Now()
 	launchLogger.Printf("launched %v\n", pid)
+
+	ptyCopyDone := make(chan struct{})
+	if ttyEnabled {
+		// Our copy of the slave fd must be closed so the master sees EOF once
+		// the script's own copy closes on exit; otherwise io.Copy below would
+		// block forever waiting for more pty output.
+		ptySlave.Close()
+		go func() {
+			io.Copy(stdoutWriter, ptyMaster)
+			close(ptyCopyDone)
+		}()
+	} else {
+		close(ptyCopyDone)
+	}
+
+	// Only -walltimeout is enforced by wall-clock watchdog; -cputimeout is
+	// enforced by the kernel via the RLIMIT_CPU set up in wrapWithRlimits
+	// above, which tracks the script's actual accumulated CPU time (wall
+	// clock elapsed would kill a mostly-sleeping/I/O-bound job too early).
+	var timeout timeoutReason
+	doneChan := make(chan struct{})
+	go watchdog(pid, wallTimeout, killGrace, doneChan, &timeout, "walltimeout")
+
 	err = scriptCmd.Wait()
+	finishedAt := time.Now()
+	close(doneChan)
+	if ttyEnabled {
+		// Wait for the last buffered chunk to drain out of the pty before
+		// tearing anything down.
+		<-ptyCopyDone
+		ptyMaster.Close()
+	}
+	closeStdoutTee()
+	closeStderrTee()
 	checkScriptErr(err)
 	resultVal := scriptCmd.ProcessState.ExitCode()
+	reason := timeout.get()
+	if reason == "" {
+		reason = "normal"
+		// RLIMIT_AS violations (-memlimit) never deliver a signal - failing
+		// allocations just return ENOMEM to the script - so there is no
+		// reliable local way to distinguish an actual OOM kill from an
+		// unrelated bare SIGKILL; leave reason "normal" rather than guess.
+		if killedBySignal(scriptCmd.ProcessState, unix.SIGXCPU) {
+			reason = "cputimeout"
+		}
+	} else if reason == "walltimeout" {
+		resultVal = -3
+	}
+	if reason == "cputimeout" {
+		resultVal = -4
+	}
 	launchLogger.Printf("script exit code: %v\n", resultVal)
 
-	exitLauncher(resultVal, resultPath)
+	userMs, sysMs, maxRSSKb := rusageFromState(scriptCmd.ProcessState)
+	exitLauncher(resultVal, resultPath, resultMeta, exitMeta{
+		Signal:     signalFromState(scriptCmd.ProcessState),
+		UserTimeMs: userMs,
+		SysTimeMs:  sysMs,
+		MaxRSSKb:   maxRSSKb,
+		StartedAt:  startedAt,
+		FinishedAt: finishedAt,
+		Reason:     reason,
+	})
 }
 
 func signalFinished(exitChan chan bool) {
 	exitChan <- true
 }
 
-func exitLauncher(exitCode int, resultPath string) {
+func exitLauncher(exitCode int, resultPath string, resultMeta bool, meta exitMeta) {
+	if resultMeta {
+		meta.ExitCode = exitCode
+		// written before the numeric result file so Jenkins never sees a
+		// completed result without its metadata
+		checkScriptErr(writeResultMeta(resultPath, meta))
+	}
 	resultFile, err := os.Create(resultPath)
 	if checkScriptErr(err) {
 		return
@@ -139,6 +881,7 @@ func exitLauncher(exitCode int, resultPath string) {
 	checkScriptErr(err)
 	err = resultFile.Close()
 	checkScriptErr(err)
+	structLogger.write("exit", os.Getpid(), []byte(strconv.Itoa(exitCode)))
 	launchLogger.Println("done")
 }
 
@@ -166,9 +909,12 @@ func heartbeat(wg *sync.WaitGroup, exitChan chan bool,
 			return
 		default:
 			// heartbeat
-			hbLogger.Println("touch log")
+			if currentLogLevel >= levelTrace {
+				hbLogger.Println("touch log")
+			}
 			err = os.Chtimes(logPath, time.Now(), time.Now())
 			loggerIfErr(hbLogger, err)
+			structLogger.write("heartbeat", os.Getpid(), []byte("alive"))
 			time.Sleep(time.Second * 3)
 		}
 	}
@@ -178,8 +924,13 @@ func heartbeat(wg *sync.WaitGroup, exitChan chan bool,
 // survive the termination of its launching process with or without the -daemon flag. No part of this
 // program should output to stdout/stderr or else it can terminate when its parent process has terminated.
 func main() {
-	var controlDir, resultPath, logPath, cookieName, cookieVal, scriptPath, interpreter, outputPath string
-	var debug, daemon bool
+	var controlDir, resultPath, logPath, cookieName, cookieVal, scriptPath, interpreter, outputPath, stderrPath, logFormat string
+	var envFilePath, envPassthrough, envUnset, fifoPath, logLevel string
+	var cpuLimit, memLimit, nprocs, filesize uint64
+	var logMaxSize, logMaxBackups int
+	var wallTimeout, cpuTimeout, killGrace time.Duration
+	var ttyRows, ttyCols int
+	var debug, daemon, resultMeta, ttyEnabled bool
 	const controlFlag = "controldir"
 	const resultFlag = "result"
 	const logFlag = "log"
@@ -188,8 +939,13 @@ func main() {
 	const scriptFlag = "script"
 	const shellFlag = "shell"
 	const outputFlag = "output"
+	const stderrFlag = "stderr"
 	const debugFlag = "debug"
 	const daemonFlag = "daemon"
+	const logFormatFlag = "logformat"
+	const envFileFlag = "envfile"
+	const envPassthroughFlag = "envpassthrough"
+	const envUnsetFlag = "envunset"
 	flag.StringVar(&controlDir, controlFlag, "", "working directory")
 	flag.StringVar(&resultPath, resultFlag, "", "full path of the result file")
 	flag.StringVar(&logPath, logFlag, "", "full path of the log file")
@@ -198,8 +954,28 @@ func main() {
 	flag.StringVar(&scriptPath, scriptFlag, "", "full path of the script to be launched")
 	flag.StringVar(&interpreter, shellFlag, "", "(optional) interpreter to use")
 	flag.StringVar(&outputPath, outputFlag, "", "(optional) if recording output, full path of the output file")
+	flag.StringVar(&stderrPath, stderrFlag, "", "(optional) full path of a file to capture stderr exclusively, never mixed with -output or the log; incompatible with -tty")
 	flag.BoolVar(&debug, debugFlag, false, "noisy output to log")
 	flag.BoolVar(&daemon, daemonFlag, false, "Immediately free binary from parent process")
+	flag.StringVar(&logFormat, logFormatFlag, "", "(optional) also write a structured per-line log next to -log: rec or json")
+	flag.StringVar(&envFilePath, envFileFlag, "", "(optional) full path of a KEY=VALUE env file; if set, becomes the script's exclusive environment instead of inheriting the JVM's")
+	flag.StringVar(&envPassthrough, envPassthroughFlag, "", "(optional) comma-separated vars to inherit from the parent in addition to -envfile")
+	flag.StringVar(&envUnset, envUnsetFlag, "", "(optional) comma-separated vars to scrub from the script's environment")
+	flag.Uint64Var(&cpuLimit, "cpulimit", 0, "(optional) RLIMIT_CPU in seconds for the script")
+	flag.Uint64Var(&memLimit, "memlimit", 0, "(optional) RLIMIT_AS in bytes for the script")
+	flag.Uint64Var(&nprocs, "nprocs", 0, "(optional) RLIMIT_NPROC for the script")
+	flag.Uint64Var(&filesize, "filesize", 0, "(optional) RLIMIT_FSIZE in bytes for the script")
+	flag.DurationVar(&wallTimeout, "walltimeout", 0, "(optional) kill the script (SIGTERM then SIGKILL) if it runs longer than this")
+	flag.DurationVar(&cpuTimeout, "cputimeout", 0, "(optional) kill the script if it accumulates more than this much CPU time; ignored when -cpulimit is set, which then bounds CPU time instead")
+	flag.DurationVar(&killGrace, "killgrace", 5*time.Second, "grace period between SIGTERM and SIGKILL for -walltimeout; 0 kills immediately. -cputimeout has no configurable grace, it is enforced by the kernel's own RLIMIT_CPU")
+	flag.StringVar(&fifoPath, "fifo", "", "(optional) stream output through a named pipe at this path instead of a plain file")
+	flag.BoolVar(&resultMeta, "resultmeta", false, "(optional) also write a recfile-style metadata block to <result>.meta")
+	flag.StringVar(&logLevel, "loglevel", "", "(optional) off|debug|trace; defaults to \"debug\" if -debug is set, else off")
+	flag.IntVar(&logMaxSize, "logmaxsize", 10*1024*1024, "rotate the debug log once it exceeds this many bytes")
+	flag.IntVar(&logMaxBackups, "logmaxbackups", 5, "number of rotated debug log generations to keep")
+	flag.BoolVar(&ttyEnabled, "tty", false, "(optional) allocate a pseudo-terminal and attach it to the script's stdin/stdout/stderr")
+	flag.IntVar(&ttyRows, "ttyrows", 24, "(optional) pty window height, used only when -tty is set")
+	flag.IntVar(&ttyCols, "ttycols", 80, "(optional) pty window width, used only when -tty is set")
 	flag.Parse()
 
 	// Validate that the required flags were all command-line defined
@@ -221,6 +997,20 @@ func main() {
 		}
 		return
 	}
+	if ttyEnabled && stderrPath != "" {
+		// -tty attaches the pty to stdin/stdout/stderr as one combined
+		// stream, so there is no separate stderr stream left to route into
+		// -stderr; writing a silently-empty file would be worse than failing.
+		fmt.Println("-tty and -stderr cannot be used together: a pty combines stdout and stderr into one stream")
+		return
+	}
+	if killGrace < 0 {
+		// 0 is valid and means "no grace, SIGKILL immediately"; negative
+		// durations have no sane meaning so reject them instead of silently
+		// coercing to some default.
+		fmt.Println("-killgrace must not be negative")
+		return
+	}
 
 	// Double launch to free from parent process. Using a flag because it is possible for parent PID = 1 (i.e. Docker with no init process)
 	if daemon {
@@ -249,18 +1039,34 @@ func main() {
 		return
 	}
 	defer logFile.Close()
+
+	currentLogLevel = parseLogLevel(logLevel)
+	if logLevel == "" && debug {
+		currentLogLevel = levelDebug
+	}
 	mainLogOut := ioutil.Discard
 	hbLogOut := ioutil.Discard
 	launchLogOut := ioutil.Discard
-	if debug {
-		mainLogOut = logFile
-		hbLogOut = logFile
-		launchLogOut = logFile
+	var debugLog *rotatingWriter
+	if currentLogLevel >= levelDebug {
+		debugLog, logErr = newRotatingWriter(logPath+".debug", int64(logMaxSize), logMaxBackups)
+		if checkIfErr("launcher", logErr) {
+			return
+		}
+		defer debugLog.close()
+		mainLogOut = debugLog
+		hbLogOut = debugLog
+		launchLogOut = debugLog
 	}
 	mainLogger = log.New(mainLogOut, "MAIN ", log.Lmicroseconds|log.Lshortfile)
 	hbLogger = log.New(hbLogOut, "HEARBEAT ", log.Lmicroseconds|log.Lshortfile)
 	launchLogger = log.New(launchLogOut, "LAUNCHER ", log.Lmicroseconds|log.Lshortfile)
 	scriptLogger = log.New(logFile, "", log.Lmicroseconds|log.Lshortfile)
+	structLogger, logErr = openStructLog(logPath, logFormat)
+	if checkIfErr("launcher", logErr) {
+		return
+	}
+	defer structLogger.close()
 
 	for key, val := range defined {
 		mainLogger.Printf("%v: %v", key, val)
@@ -270,12 +1076,15 @@ func main() {
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, unix.SIGINT, unix.SIGTERM, unix.SIGHUP)
-	go signalCatcher(sigChan)
+	go signalCatcher(sigChan, debugLog)
 
 	exitChan := make(chan bool)
 	var wg sync.WaitGroup
 	wg.Add(2)
-	go launcher(&wg, exitChan, cookieName, cookieVal, interpreter, scriptPath, resultPath, outputPath)
+	go launcher(&wg, exitChan, cookieName, cookieVal, interpreter, scriptPath, resultPath, outputPath, stderrPath,
+		envFilePath, envPassthrough, envUnset,
+		cpuLimit, memLimit, nprocs, filesize, wallTimeout, cpuTimeout, killGrace, fifoPath, resultMeta,
+		ttyEnabled, ttyRows, ttyCols)
 	go heartbeat(&wg, exitChan, controlDir, resultPath, logPath)
 	wg.Wait()
 	signal.Stop(sigChan)